@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// defaultMaxBufferSize and defaultMaxBufferTime are used when AutoBatch is
+// constructed with a maxBufferSize or maxBufferTime <= 0.
+const (
+	defaultMaxBufferSize = 128
+	defaultMaxBufferTime = 500 * time.Millisecond
+)
+
+// AutoBatch wraps a StorjDS and buffers Put/Delete calls into a storjBatch,
+// flushing automatically once maxBufferSize operations have accumulated or
+// maxBufferTime has elapsed since the first buffered op, whichever comes
+// first. This turns many small writes, like an IPFS blockstore.PutMany
+// ingesting a DAG, into a handful of parallel, high-throughput Commits,
+// analogous to go-datastore's autobatch package.
+type AutoBatch struct {
+	storj *StorjDS
+
+	maxBufferSize int
+	maxBufferTime time.Duration
+
+	mu      sync.Mutex
+	batch   *storjBatch
+	timer   *time.Timer
+	pending int
+}
+
+// NewAutoBatch creates an AutoBatch over storj. A maxBufferSize or
+// maxBufferTime <= 0 uses the package defaults.
+func NewAutoBatch(storj *StorjDS, maxBufferSize int, maxBufferTime time.Duration) *AutoBatch {
+	if maxBufferSize <= 0 {
+		maxBufferSize = defaultMaxBufferSize
+	}
+	if maxBufferTime <= 0 {
+		maxBufferTime = defaultMaxBufferTime
+	}
+
+	return &AutoBatch{
+		storj:         storj,
+		maxBufferSize: maxBufferSize,
+		maxBufferTime: maxBufferTime,
+	}
+}
+
+func (a *AutoBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.ensureBatchLocked(ctx); err != nil {
+		return err
+	}
+	if err := a.batch.Put(ctx, key, value); err != nil {
+		return err
+	}
+
+	return a.afterOpLocked(ctx)
+}
+
+func (a *AutoBatch) Delete(ctx context.Context, key ds.Key) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.ensureBatchLocked(ctx); err != nil {
+		return err
+	}
+	if err := a.batch.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	return a.afterOpLocked(ctx)
+}
+
+// Flush commits any buffered operations immediately.
+func (a *AutoBatch) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.flushLocked(ctx)
+}
+
+func (a *AutoBatch) ensureBatchLocked(ctx context.Context) error {
+	if a.batch != nil {
+		return nil
+	}
+
+	b, err := a.storj.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.batch = b.(*storjBatch)
+	a.pending = 0
+	a.timer = time.AfterFunc(a.maxBufferTime, func() {
+		_ = a.Flush(context.Background())
+	})
+
+	return nil
+}
+
+func (a *AutoBatch) afterOpLocked(ctx context.Context) error {
+	a.pending++
+	if a.pending >= a.maxBufferSize {
+		return a.flushLocked(ctx)
+	}
+
+	return nil
+}
+
+func (a *AutoBatch) flushLocked(ctx context.Context) error {
+	if a.batch == nil {
+		return nil
+	}
+
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+
+	batch := a.batch
+	a.batch = nil
+	a.pending = 0
+
+	return batch.Commit(ctx)
+}
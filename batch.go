@@ -0,0 +1,107 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/zeebo/errs"
+)
+
+// defaultBatchConcurrency is used when Config.BatchConcurrency is left at
+// its zero value.
+const defaultBatchConcurrency = 8
+
+type storjBatch struct {
+	storj *StorjDS
+	ops   map[ds.Key]batchOp
+}
+
+type batchOp struct {
+	value  []byte
+	delete bool
+}
+
+func (b *storjBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b.storj.logger.Log(LogEvent{Op: "batch_put", Key: key.String(), Bytes: len(value)})
+
+	b.ops[key] = batchOp{
+		value:  value,
+		delete: false,
+	}
+
+	return nil
+}
+
+func (b *storjBatch) Delete(ctx context.Context, key ds.Key) error {
+	b.storj.logger.Log(LogEvent{Op: "batch_delete", Key: key.String()})
+
+	b.ops[key] = batchOp{
+		value:  nil,
+		delete: true,
+	}
+
+	return nil
+}
+
+// Commit dispatches the buffered Puts and Deletes across a worker pool
+// sized by Config.BatchConcurrency, since each op is a separate round trip
+// to Storj and running them sequentially makes ingesting a large DAG very
+// slow. All ops run to completion even if some fail; the returned error
+// combines every failure, each one naming the key that caused it.
+func (b *storjBatch) Commit(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { b.storj.logOp("batch_commit", "", 0, start, err) }()
+
+	concurrency := b.storj.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBatchConcurrency
+	}
+	if concurrency > len(b.ops) {
+		concurrency = len(b.ops)
+	}
+
+	type job struct {
+		key ds.Key
+		op  batchOp
+	}
+
+	jobs := make(chan job)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var group errs.Group
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				var err error
+				if j.op.delete {
+					err = b.storj.Delete(ctx, j.key)
+				} else {
+					err = b.storj.Put(ctx, j.key, j.op.value)
+				}
+				if err != nil {
+					mu.Lock()
+					group.Add(fmt.Errorf("%s: %w", j.key, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for key, op := range b.ops {
+		jobs <- job{key: key, op: op}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return group.Err()
+}
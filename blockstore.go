@@ -0,0 +1,131 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Blockstore adapts a StorjDS to the go-ipfs blockstore.Blockstore
+// interface, keying objects by their CID. Put/Get go through storj.Put/
+// storj.Get rather than PutStream/GetStream directly, so blocks are
+// pack-aware whenever Config.Pack is enabled.
+type Blockstore struct {
+	storj      *StorjDS
+	hashOnRead bool
+}
+
+// NewBlockstore wraps storj as a blockstore.Blockstore.
+func NewBlockstore(storj *StorjDS) *Blockstore {
+	return &Blockstore{storj: storj}
+}
+
+func (b *Blockstore) HashOnRead(enabled bool) {
+	b.hashOnRead = enabled
+}
+
+func (b *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return b.storj.Delete(ctx, dsKeyFromCid(c))
+}
+
+func (b *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return b.storj.Has(ctx, dsKeyFromCid(c))
+}
+
+func (b *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	return b.storj.GetSize(ctx, dsKeyFromCid(c))
+}
+
+func (b *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	value, err := b.storj.Get(ctx, dsKeyFromCid(c))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.hashOnRead {
+		rehash, err := c.Prefix().Sum(value)
+		if err != nil {
+			return nil, err
+		}
+		if !rehash.Equals(c) {
+			return nil, blocks.ErrWrongHash
+		}
+		return blocks.NewBlockWithCid(value, c)
+	}
+
+	return unverifiedBlock{cid: c, data: value}, nil
+}
+
+// unverifiedBlock implements blocks.Block without recomputing the digest
+// of data, used when Blockstore.HashOnRead is disabled.
+type unverifiedBlock struct {
+	cid  cid.Cid
+	data []byte
+}
+
+func (blk unverifiedBlock) Cid() cid.Cid    { return blk.cid }
+func (blk unverifiedBlock) RawData() []byte { return blk.data }
+func (blk unverifiedBlock) String() string  { return blk.cid.String() }
+func (blk unverifiedBlock) Loggable() map[string]interface{} {
+	return map[string]interface{}{"block": blk.cid.String()}
+}
+
+func (b *Blockstore) Put(ctx context.Context, block blocks.Block) error {
+	return b.storj.Put(ctx, dsKeyFromCid(block.Cid()), block.RawData())
+}
+
+func (b *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		if err := b.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	results, err := b.storj.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		defer results.Close()
+
+		for res := range results.Next() {
+			if res.Error != nil {
+				return
+			}
+
+			c, err := cidFromDsKey(ds.NewKey(res.Entry.Key))
+			if err != nil {
+				continue
+			}
+
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func dsKeyFromCid(c cid.Cid) ds.Key {
+	return ds.NewKey(c.String())
+}
+
+func cidFromDsKey(k ds.Key) (cid.Cid, error) {
+	return cid.Decode(strings.TrimPrefix(k.String(), "/"))
+}
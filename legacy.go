@@ -0,0 +1,104 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// LegacyDatastore mirrors ds.Datastore as it existed before go-datastore
+// grew context.Context arguments. It lets consumers that have not migrated
+// yet keep building against StorjDS during the transition.
+type LegacyDatastore interface {
+	Put(key ds.Key, value []byte) error
+	Sync(prefix ds.Key) error
+	Get(key ds.Key) ([]byte, error)
+	Has(key ds.Key) (exists bool, err error)
+	GetSize(key ds.Key) (size int, err error)
+	Delete(key ds.Key) error
+	Query(q dsq.Query) (dsq.Results, error)
+	Close() error
+}
+
+// LegacyBatching mirrors ds.Batching as it existed before the context-aware
+// API, pairing LegacyDatastore with a context-free Batch method.
+type LegacyBatching interface {
+	LegacyDatastore
+	Batch() (LegacyBatch, error)
+}
+
+// LegacyBatch mirrors ds.Batch without a context.Context argument.
+type LegacyBatch interface {
+	Put(key ds.Key, value []byte) error
+	Delete(key ds.Key) error
+	Commit() error
+}
+
+// LegacyDS adapts a context-aware StorjDS to LegacyBatching, issuing every
+// call with context.Background(). It exists purely as a migration shim and
+// should not be used by new code, which should take a context.Context from
+// the caller and talk to StorjDS directly.
+type LegacyDS struct {
+	*StorjDS
+}
+
+func (storj LegacyDS) Put(key ds.Key, value []byte) error {
+	return storj.StorjDS.Put(context.Background(), key, value)
+}
+
+func (storj LegacyDS) Sync(prefix ds.Key) error {
+	return storj.StorjDS.Sync(context.Background(), prefix)
+}
+
+func (storj LegacyDS) Get(key ds.Key) ([]byte, error) {
+	return storj.StorjDS.Get(context.Background(), key)
+}
+
+func (storj LegacyDS) Has(key ds.Key) (exists bool, err error) {
+	return storj.StorjDS.Has(context.Background(), key)
+}
+
+func (storj LegacyDS) GetSize(key ds.Key) (size int, err error) {
+	return storj.StorjDS.GetSize(context.Background(), key)
+}
+
+func (storj LegacyDS) Delete(key ds.Key) error {
+	return storj.StorjDS.Delete(context.Background(), key)
+}
+
+func (storj LegacyDS) Query(q dsq.Query) (dsq.Results, error) {
+	return storj.StorjDS.Query(context.Background(), q)
+}
+
+func (storj LegacyDS) Batch() (LegacyBatch, error) {
+	batch, err := storj.StorjDS.Batch(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return legacyBatch{batch: batch}, nil
+}
+
+type legacyBatch struct {
+	batch ds.Batch
+}
+
+func (b legacyBatch) Put(key ds.Key, value []byte) error {
+	return b.batch.Put(context.Background(), key, value)
+}
+
+func (b legacyBatch) Delete(key ds.Key) error {
+	return b.batch.Delete(context.Background(), key)
+}
+
+func (b legacyBatch) Commit() error {
+	return b.batch.Commit(context.Background())
+}
+
+var (
+	_ LegacyBatching = LegacyDS{}
+	_ LegacyBatch    = legacyBatch{}
+)
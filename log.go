@@ -0,0 +1,53 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// LogEvent is a single structured datastore event. StorjDS emits one per
+// operation instead of the free-form Printf lines it used to write.
+type LogEvent struct {
+	Op       string
+	Key      string
+	Bytes    int
+	Duration time.Duration
+	Err      error
+}
+
+// Logger receives a LogEvent for every StorjDS operation. It's deliberately
+// a one-method interface so a go-log, zap, or slog logger can satisfy it
+// with a small adapter, instead of StorjDS depending on any of them
+// directly.
+type Logger interface {
+	Log(event LogEvent)
+}
+
+// stdLogger adapts a *log.Logger to Logger. It backs Config.LogFile so
+// that option keeps working unchanged for callers who haven't supplied
+// their own Config.Logger.
+type stdLogger struct {
+	log *log.Logger
+}
+
+func (s stdLogger) Log(event LogEvent) {
+	line := fmt.Sprintf("%s --- key: %s", event.Op, event.Key)
+	if event.Bytes > 0 {
+		line += fmt.Sprintf(" --- bytes: %d", event.Bytes)
+	}
+	line += fmt.Sprintf(" --- duration: %s", event.Duration)
+	if event.Err != nil {
+		line += fmt.Sprintf(" --- err: %s", event.Err)
+	}
+	s.log.Println(line)
+}
+
+// noopLogger discards every event. It's the default when neither
+// Config.Logger nor Config.LogFile is set.
+type noopLogger struct{}
+
+func (noopLogger) Log(LogEvent) {}
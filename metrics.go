@@ -0,0 +1,80 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"errors"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsRegisterer is satisfied by *prometheus.Registry and by
+// prometheus.DefaultRegisterer, so operators can plug StorjDS's metrics
+// into whichever registry their process already exposes.
+type MetricsRegisterer interface {
+	Register(prometheus.Collector) error
+}
+
+// metrics holds the Prometheus collectors StorjDS reports through, so
+// operators running IPFS on Storj can alert on error rates and tail
+// latency without parsing log files. It's nil when Config.MetricsRegisterer
+// isn't set, in which case every method becomes a no-op.
+type metrics struct {
+	ops      *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	notFound prometheus.Counter
+}
+
+func newMetrics(reg MetricsRegisterer) *metrics {
+	if reg == nil {
+		return nil
+	}
+
+	m := &metrics{
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "storjds",
+			Name:      "ops_total",
+			Help:      "Number of datastore operations, by kind.",
+		}, []string{"op"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "storjds",
+			Name:      "bytes_total",
+			Help:      "Bytes transferred, by operation kind.",
+		}, []string{"op"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "storjds",
+			Name:      "op_duration_seconds",
+			Help:      "Datastore operation latency, by kind.",
+		}, []string{"op"}),
+		notFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "storjds",
+			Name:      "not_found_total",
+			Help:      "Number of operations that returned ds.ErrNotFound.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.ops, m.bytes, m.latency, m.notFound} {
+		_ = reg.Register(c)
+	}
+
+	return m
+}
+
+func (m *metrics) observe(op string, bytes int, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.ops.WithLabelValues(op).Inc()
+	if bytes > 0 {
+		m.bytes.WithLabelValues(op).Add(float64(bytes))
+	}
+	m.latency.WithLabelValues(op).Observe(duration.Seconds())
+	if errors.Is(err, ds.ErrNotFound) {
+		m.notFound.Inc()
+	}
+}
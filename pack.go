@@ -0,0 +1,571 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/zeebo/errs"
+)
+
+const (
+	packIndexBucket = "index"
+
+	defaultPackSize         = 64 * 1024 * 1024
+	defaultCompactThreshold = 0.5
+)
+
+// PackConfig configures the optional pack-file aggregation mode. Storj
+// bills and rate-limits per object, and IPFS blocks (~256KiB) are far
+// below the size Storj is optimized for, so PackStore appends small Puts
+// to a local pack file and uploads the whole pack as a single Storj
+// object once it fills up.
+type PackConfig struct {
+	// Dir holds local pack files and the BoltDB index.
+	Dir string
+
+	// PackSize is the size, in bytes, at which a pack is sealed and
+	// uploaded as a single Storj object. Defaults to defaultPackSize.
+	PackSize int64
+
+	// CompactThreshold is the live-byte ratio (0-1) below which the
+	// compactor rewrites a pack to reclaim space held by tombstoned
+	// entries. Defaults to defaultCompactThreshold.
+	CompactThreshold float64
+}
+
+// packRecord is the BoltDB index entry for a single ds.Key: where its
+// bytes live within a pack object.
+type packRecord struct {
+	PackKey   string `json:"pack_key"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Tombstone bool   `json:"tombstone"`
+}
+
+// packBackend is the subset of StorjDS that PackStore needs: uploading a
+// sealed pack, deleting a superseded one, and ranged reads from a pack
+// object. Keeping it as an interface (rather than taking *StorjDS
+// directly) lets PackStore be exercised in tests against a fake, without
+// a live Storj project.
+type packBackend interface {
+	PutStream(ctx context.Context, key ds.Key, r io.Reader) error
+	Delete(ctx context.Context, key ds.Key) error
+	downloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	logPack(event LogEvent)
+}
+
+var _ packBackend = (*StorjDS)(nil)
+
+// PackStore layers pack-file aggregation on top of a packBackend. Get/Has/
+// GetSize consult the BoltDB index first and, when the key is already
+// sealed into a pack, issue a ranged download for just that block's
+// bytes instead of fetching the whole pack.
+type PackStore struct {
+	storj packBackend
+	conf  PackConfig
+	db    *bolt.DB
+
+	mu         sync.Mutex
+	current    *os.File
+	currentKey string
+	size       int64
+}
+
+// NewPackStore opens (or creates) the pack index under conf.Dir and
+// returns a PackStore wrapping storj.
+func NewPackStore(storj packBackend, conf PackConfig) (*PackStore, error) {
+	if conf.PackSize <= 0 {
+		conf.PackSize = defaultPackSize
+	}
+	if conf.CompactThreshold <= 0 {
+		conf.CompactThreshold = defaultCompactThreshold
+	}
+
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pack dir: %s", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(conf.Dir, "index.db"), 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pack index: %s", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(packIndexBucket))
+		return err
+	})
+	if err != nil {
+		return nil, errs.Combine(err, db.Close())
+	}
+
+	return &PackStore{storj: storj, conf: conf, db: db}, nil
+}
+
+// Close seals any in-progress pack and closes the index.
+func (p *PackStore) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	if p.current != nil {
+		err = p.sealLocked(context.Background())
+	}
+
+	return errs.Combine(err, p.db.Close())
+}
+
+// Put appends value to the current pack file and, once that pack reaches
+// conf.PackSize, rotates in a fresh one and uploads the sealed pack. The
+// upload itself runs after p.mu is released (see rotateLocked), so a pack
+// filling up doesn't block every other Put/Get/Has/Delete for as long as
+// the upload takes.
+func (p *PackStore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := p.appendLocked(key, value)
+	if err != nil {
+		return err
+	}
+	if sealed == nil {
+		return nil
+	}
+
+	return p.upload(ctx, sealed)
+}
+
+func (p *PackStore) appendLocked(key ds.Key, value []byte) (*sealedPack, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		if err := p.openPackLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	offset := p.size
+	n, err := p.current.Write(value)
+	if err != nil {
+		return nil, err
+	}
+	p.size += int64(n)
+
+	if err := p.putRecord(key, packRecord{PackKey: p.currentKey, Offset: offset, Length: int64(n)}); err != nil {
+		return nil, err
+	}
+
+	if p.size < p.conf.PackSize {
+		return nil, nil
+	}
+
+	return p.rotateLocked()
+}
+
+func (p *PackStore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	record, ok, err := p.getRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || record.Tombstone {
+		return nil, ds.ErrNotFound
+	}
+
+	download, err := p.storj.downloadRange(ctx, record.PackKey, record.Offset, record.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer download.Close()
+
+	return io.ReadAll(download)
+}
+
+func (p *PackStore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	record, ok, err := p.getRecord(key)
+	if err != nil {
+		return false, err
+	}
+	return ok && !record.Tombstone, nil
+}
+
+func (p *PackStore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	record, ok, err := p.getRecord(key)
+	if err != nil {
+		return -1, err
+	}
+	if !ok || record.Tombstone {
+		return -1, ds.ErrNotFound
+	}
+	return int(record.Length), nil
+}
+
+// Delete tombstones key. The bytes are reclaimed later by the compactor
+// rather than immediately, since they live inside a shared pack object.
+func (p *PackStore) Delete(ctx context.Context, key ds.Key) error {
+	record, ok, err := p.getRecord(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	record.Tombstone = true
+	return p.putRecord(key, record)
+}
+
+func (p *PackStore) openPackLocked() error {
+	token := newPackToken()
+
+	f, err := os.Create(filepath.Join(p.conf.Dir, token))
+	if err != nil {
+		return err
+	}
+
+	p.current = f
+	p.currentKey = "packs/" + token
+	p.size = 0
+	return nil
+}
+
+// sealLocked seals the in-progress pack and uploads it, blocking until the
+// upload finishes, for callers (Close, Flush) that need the pack durably
+// persisted before they return. Put's automatic seal uses rotateLocked
+// and uploads separately instead, so it doesn't hold p.mu for the upload.
+func (p *PackStore) sealLocked(ctx context.Context) error {
+	if p.current == nil {
+		return nil
+	}
+
+	sealed, err := p.rotateLocked()
+	if err != nil {
+		return err
+	}
+
+	return p.upload(ctx, sealed)
+}
+
+// sealedPack is a pack file that has been closed and is waiting to be
+// uploaded to Storj as a single object.
+type sealedPack struct {
+	path string
+	key  string
+}
+
+// rotateLocked closes the current pack file and clears it, so Put can
+// open a fresh one on its next call without waiting on the sealed pack's
+// upload. The caller is responsible for uploading the returned sealedPack.
+func (p *PackStore) rotateLocked() (*sealedPack, error) {
+	path := p.current.Name()
+	key := p.currentKey
+
+	if err := p.current.Close(); err != nil {
+		return nil, err
+	}
+	p.current = nil
+	p.currentKey = ""
+	p.size = 0
+
+	return &sealedPack{path: path, key: key}, nil
+}
+
+// upload uploads a sealed pack file to Storj and removes the local copy.
+// It does not touch PackStore state, so it's safe to call without p.mu.
+func (p *PackStore) upload(ctx context.Context, sealed *sealedPack) error {
+	f, err := os.Open(sealed.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := p.storj.PutStream(ctx, ds.NewKey(sealed.key), f); err != nil {
+		return err
+	}
+
+	return os.Remove(sealed.path)
+}
+
+func (p *PackStore) getRecord(key ds.Key) (packRecord, bool, error) {
+	var record packRecord
+	var found bool
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(packIndexBucket)).Get([]byte(storjKey(key)))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &record)
+	})
+
+	return record, found, err
+}
+
+func (p *PackStore) putRecord(key ds.Key, record packRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(packIndexBucket)).Put([]byte(storjKey(key)), data)
+	})
+}
+
+func newPackToken() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Flush seals the in-progress pack immediately and uploads it as a single
+// Storj object, without waiting for it to reach conf.PackSize.
+func (p *PackStore) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.sealLocked(ctx)
+}
+
+// Compact runs a single compaction pass immediately, rewriting any pack
+// whose live-byte ratio has fallen below conf.CompactThreshold. RunCompactor
+// calls this on a timer; callers that want synchronous control (including
+// tests) can call it directly.
+func (p *PackStore) Compact(ctx context.Context) error {
+	return p.compactOnce(ctx)
+}
+
+// RunCompactor periodically rewrites packs whose live-byte ratio has
+// fallen below conf.CompactThreshold, dropping tombstoned entries. It
+// blocks until ctx is done, so callers that want background compaction
+// should run it in its own goroutine.
+func (p *PackStore) RunCompactor(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := p.Compact(ctx); err != nil {
+				p.storj.logPack(LogEvent{Op: "compact", Err: err})
+			}
+		}
+	}
+}
+
+func (p *PackStore) compactOnce(ctx context.Context) error {
+	type packStats struct {
+		live  int64
+		total int64
+	}
+
+	stats := make(map[string]*packStats)
+	live := make(map[string]packRecord) // ds key (string form) -> record
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(packIndexBucket)).ForEach(func(k, v []byte) error {
+			var record packRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+
+			st, ok := stats[record.PackKey]
+			if !ok {
+				st = &packStats{}
+				stats[record.PackKey] = st
+			}
+			st.total += record.Length
+
+			if !record.Tombstone {
+				st.live += record.Length
+				live[string(append([]byte(nil), k...))] = record
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for packKey, st := range stats {
+		if st.total == 0 || float64(st.live)/float64(st.total) >= p.conf.CompactThreshold {
+			continue
+		}
+		if err := p.rewritePack(ctx, packKey, live); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewritePack downloads the still-live bytes of oldPackKey and re-uploads
+// them as a new, tighter pack, then repoints the index at the new pack
+// and deletes the old object.
+func (p *PackStore) rewritePack(ctx context.Context, oldPackKey string, records map[string]packRecord) error {
+	tmp, err := os.CreateTemp(p.conf.Dir, "compact-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	newKey := "packs/" + newPackToken()
+	var offset int64
+	updates := make(map[string]packRecord)
+
+	for keyStr, record := range records {
+		if record.PackKey != oldPackKey {
+			continue
+		}
+
+		download, err := p.storj.downloadRange(ctx, record.PackKey, record.Offset, record.Length)
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+
+		n, err := io.Copy(tmp, download)
+		_ = download.Close()
+		if err != nil {
+			_ = tmp.Close()
+			return err
+		}
+
+		updates[keyStr] = packRecord{PackKey: newKey, Offset: offset, Length: n}
+		offset += n
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if len(updates) == 0 {
+		// Every entry in the old pack was tombstoned; just drop it.
+		return errs.Combine(p.deletePackRecords(oldPackKey), p.storj.Delete(ctx, ds.NewKey(oldPackKey)))
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	uploadErr := p.storj.PutStream(ctx, ds.NewKey(newKey), f)
+	_ = f.Close()
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(packIndexBucket))
+		for keyStr, record := range updates {
+			// Re-check against the live index, not the pre-rewrite
+			// snapshot: a Delete (or another compaction) may have
+			// landed on this key while we were downloading and
+			// re-uploading oldPackKey. Writing the rewritten, live
+			// copy back unconditionally would clobber that and
+			// resurrect a deleted block.
+			if cur := b.Get([]byte(keyStr)); cur != nil {
+				var curRecord packRecord
+				if err := json.Unmarshal(cur, &curRecord); err != nil {
+					return err
+				}
+				if curRecord.Tombstone || curRecord.PackKey != oldPackKey {
+					continue
+				}
+			}
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(keyStr), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.storj.Delete(ctx, ds.NewKey(oldPackKey))
+}
+
+// queryLister returns a rawLister over the live (non-tombstoned) keys in
+// the pack index whose storjKey form starts with prefix, for Query's
+// pack-aware listing path: once Config.Pack is enabled, the bucket only
+// holds pack objects rather than one object per key, so Query can't list
+// the bucket directly and has to enumerate the index instead.
+func (p *PackStore) queryLister(prefix string) (rawLister, error) {
+	var entries []rawEntry
+	pfx := []byte(prefix)
+
+	err := p.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(packIndexBucket)).Cursor()
+		for k, v := c.Seek(pfx); k != nil && bytes.HasPrefix(k, pfx); k, v = c.Next() {
+			var record packRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.Tombstone {
+				continue
+			}
+			entries = append(entries, rawEntry{key: string(append([]byte(nil), k...)), size: int(record.Length)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i := 0
+	return func() (rawEntry, bool, error) {
+		if i >= len(entries) {
+			return rawEntry{}, false, nil
+		}
+		e := entries[i]
+		i++
+		return e, true, nil
+	}, nil
+}
+
+func (p *PackStore) deletePackRecords(packKey string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(packIndexBucket))
+		c := b.Cursor()
+
+		var toDelete [][]byte
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var record packRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.PackKey == packKey {
+				toDelete = append(toDelete, append([]byte(nil), k...))
+			}
+		}
+
+		for _, k := range toDelete {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
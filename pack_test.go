@@ -0,0 +1,278 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// fakeBackend is an in-memory packBackend, so PackStore can be tested
+// without a live Storj project.
+type fakeBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{objects: make(map[string][]byte)}
+}
+
+func (f *fakeBackend) PutStream(ctx context.Context, key ds.Key, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[storjKey(key)] = data
+	return nil
+}
+
+func (f *fakeBackend) Delete(ctx context.Context, key ds.Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, storjKey(key))
+	return nil
+}
+
+func (f *fakeBackend) downloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, ds.ErrNotFound
+	}
+
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	return io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (f *fakeBackend) logPack(LogEvent) {}
+
+func (f *fakeBackend) objectCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.objects)
+}
+
+func TestPackStorePutSealGet(t *testing.T) {
+	backend := newFakeBackend()
+
+	store, err := NewPackStore(backend, PackConfig{Dir: t.TempDir(), PackSize: 8})
+	if err != nil {
+		t.Fatalf("NewPackStore: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	key := ds.NewKey("/block/a")
+	value := []byte("12345678") // meets PackSize, so Put seals immediately
+
+	if err := store.Put(ctx, key, value); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if got := backend.objectCount(); got != 1 {
+		t.Fatalf("expected the pack to be sealed into one object, got %d", got)
+	}
+
+	got, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("Get returned %q, want %q", got, value)
+	}
+}
+
+func TestPackStoreTombstoneAndCompact(t *testing.T) {
+	backend := newFakeBackend()
+
+	store, err := NewPackStore(backend, PackConfig{
+		Dir:              t.TempDir(),
+		PackSize:         1 << 20,
+		CompactThreshold: 0.9,
+	})
+	if err != nil {
+		t.Fatalf("NewPackStore: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	keyA := ds.NewKey("/block/a")
+	keyB := ds.NewKey("/block/b")
+
+	if err := store.Put(ctx, keyA, []byte("aaaa")); err != nil {
+		t.Fatalf("Put a: %s", err)
+	}
+	if err := store.Put(ctx, keyB, []byte("bbbb")); err != nil {
+		t.Fatalf("Put b: %s", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := backend.objectCount(); got != 1 {
+		t.Fatalf("expected one sealed pack before compaction, got %d", got)
+	}
+
+	if err := store.Delete(ctx, keyA); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+
+	if ok, err := store.Has(ctx, keyA); err != nil || ok {
+		t.Fatalf("Has(a) after Delete = %v, %v, want false, nil", ok, err)
+	}
+
+	if err := store.Compact(ctx); err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+
+	if ok, err := store.Has(ctx, keyA); err != nil || ok {
+		t.Fatalf("Has(a) after Compact = %v, %v, want false, nil", ok, err)
+	}
+
+	got, err := store.Get(ctx, keyB)
+	if err != nil {
+		t.Fatalf("Get b after Compact: %s", err)
+	}
+	if !bytes.Equal(got, []byte("bbbb")) {
+		t.Fatalf("Get b returned %q, want %q", got, "bbbb")
+	}
+
+	// Compaction should have rewritten the pack into a new, tighter object
+	// and dropped the old one.
+	if got := backend.objectCount(); got != 1 {
+		t.Fatalf("expected one pack object after compaction, got %d", got)
+	}
+}
+
+// TestPackStoreCompactRaceWithDelete drives rewritePack with the exact
+// stale-snapshot scenario compactOnce can produce under concurrency: a
+// Delete lands on a key after its record was read but before rewritePack
+// finishes. The rewritten, live copy from the snapshot must not clobber
+// the tombstone written in between.
+func TestPackStoreCompactRaceWithDelete(t *testing.T) {
+	backend := newFakeBackend()
+
+	store, err := NewPackStore(backend, PackConfig{
+		Dir:              t.TempDir(),
+		PackSize:         1 << 20,
+		CompactThreshold: 0.9,
+	})
+	if err != nil {
+		t.Fatalf("NewPackStore: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	keyA := ds.NewKey("/block/a")
+	keyB := ds.NewKey("/block/b")
+
+	if err := store.Put(ctx, keyA, []byte("aaaa")); err != nil {
+		t.Fatalf("Put a: %s", err)
+	}
+	if err := store.Put(ctx, keyB, []byte("bbbb")); err != nil {
+		t.Fatalf("Put b: %s", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	// Snapshot both records as compactOnce would have, before the race.
+	recordA, ok, err := store.getRecord(keyA)
+	if err != nil || !ok {
+		t.Fatalf("getRecord(a) = %v, %v, %v", recordA, ok, err)
+	}
+	recordB, ok, err := store.getRecord(keyB)
+	if err != nil || !ok {
+		t.Fatalf("getRecord(b) = %v, %v, %v", recordB, ok, err)
+	}
+	oldPackKey := recordA.PackKey
+	snapshot := map[string]packRecord{
+		storjKey(keyA): recordA,
+		storjKey(keyB): recordB,
+	}
+
+	// Delete keyA after the snapshot was taken but before rewritePack
+	// runs, the same way a concurrent caller's Delete could land.
+	if err := store.Delete(ctx, keyA); err != nil {
+		t.Fatalf("Delete a: %s", err)
+	}
+
+	if err := store.rewritePack(ctx, oldPackKey, snapshot); err != nil {
+		t.Fatalf("rewritePack: %s", err)
+	}
+
+	if ok, err := store.Has(ctx, keyA); err != nil || ok {
+		t.Fatalf("Has(a) after racing Delete+rewritePack = %v, %v, want false, nil", ok, err)
+	}
+
+	got, err := store.Get(ctx, keyB)
+	if err != nil {
+		t.Fatalf("Get b after rewritePack: %s", err)
+	}
+	if !bytes.Equal(got, []byte("bbbb")) {
+		t.Fatalf("Get b returned %q, want %q", got, "bbbb")
+	}
+}
+
+// TestPackStoreQueryLister checks that the pack-aware Query listing path
+// only yields live keys under the given prefix, reading straight from the
+// pack index rather than the (fake) backend.
+func TestPackStoreQueryLister(t *testing.T) {
+	backend := newFakeBackend()
+
+	store, err := NewPackStore(backend, PackConfig{Dir: t.TempDir(), PackSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewPackStore: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.Put(ctx, ds.NewKey("/block/a"), []byte("aaaa")); err != nil {
+		t.Fatalf("Put a: %s", err)
+	}
+	if err := store.Put(ctx, ds.NewKey("/block/b"), []byte("bbbb")); err != nil {
+		t.Fatalf("Put b: %s", err)
+	}
+	if err := store.Put(ctx, ds.NewKey("/other/c"), []byte("cc")); err != nil {
+		t.Fatalf("Put c: %s", err)
+	}
+	if err := store.Delete(ctx, ds.NewKey("/block/b")); err != nil {
+		t.Fatalf("Delete b: %s", err)
+	}
+
+	list, err := store.queryLister("block/")
+	if err != nil {
+		t.Fatalf("queryLister: %s", err)
+	}
+
+	var keys []string
+	for {
+		entry, ok, err := list()
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		if !ok {
+			break
+		}
+		keys = append(keys, entry.key)
+	}
+
+	if len(keys) != 1 || keys[0] != "block/a" {
+		t.Fatalf(`queryLister("block/") = %v, want [block/a] (b tombstoned, c out of prefix)`, keys)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+
+	"storj.io/uplink"
+)
+
+// defaultMaxQueryBufferEntries is used when Config.MaxQueryBufferEntries is
+// left at its zero value.
+const defaultMaxQueryBufferEntries = 10000
+
+// rawEntry is one entry from the raw listing stage of Query, before
+// Orders/Filters/Offset/Limit are applied.
+type rawEntry struct {
+	key  string
+	size int
+}
+
+// rawLister yields successive rawEntry values. ok is false once the
+// listing is exhausted; a non-nil err stops it early.
+type rawLister func() (entry rawEntry, ok bool, err error)
+
+// Query lists the keys under q.Prefix. With Config.Pack unset, that's a
+// direct listing of the Storj bucket, whose uplink.ObjectIterator keeps
+// its own resumption cursor alive across Next() calls for the lifetime of
+// the query, so listing a bucket with many keys doesn't re-list from the
+// beginning for every page. With Config.Pack set, the bucket holds pack
+// objects rather than one object per key, so the listing instead comes
+// from the pack index (see PackStore.queryLister).
+//
+// q.Offset and q.Limit, when q.Orders and q.Filters are both empty, are
+// applied directly against the raw listing: entries before the offset and
+// past the limit are never fetched, and listing stops as soon as the
+// limit is satisfied. q.Orders and q.Filters can't be pushed down the same
+// way (dsq.NaiveOrder needs every entry to sort, and a filter may compare
+// against the value), so those fall back to fetching and buffering every
+// matching entry before applying dsq.NaiveQueryApply, bounded by
+// Config.MaxQueryBufferEntries.
+func (storj *StorjDS) Query(ctx context.Context, q dsq.Query) (_ dsq.Results, err error) {
+	start := time.Now()
+	defer func() { storj.logOp("query", q.String(), 0, start, err) }()
+
+	// Storj stores a "/foo" key as "foo" so we need to trim the leading "/"
+	prefix := strings.TrimPrefix(q.Prefix, "/")
+
+	var list rawLister
+	if storj.pack != nil {
+		list, err = storj.pack.queryLister(prefix)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		objects := storj.Project.ListObjects(ctx, storj.Bucket, &uplink.ListObjectsOptions{
+			Prefix:    prefix,
+			Recursive: true,
+			System:    true,
+		})
+		if objects.Err() != nil {
+			return nil, objects.Err()
+		}
+		list = func() (rawEntry, bool, error) {
+			if !objects.Next() {
+				return rawEntry{}, false, objects.Err()
+			}
+			item := objects.Item()
+			return rawEntry{key: item.Key, size: int(item.System.ContentLength)}, true, nil
+		}
+	}
+
+	value := func(key string) ([]byte, error) {
+		return storj.Get(ctx, ds.NewKey(key))
+	}
+
+	if len(q.Orders) == 0 && len(q.Filters) == 0 {
+		return storj.queryOffsetLimit(q, list, value), nil
+	}
+
+	return storj.queryBuffered(q, list, value)
+}
+
+// queryOffsetLimit streams the raw listing, skipping q.Offset entries and
+// stopping once q.Limit have been returned, fetching a value only for an
+// entry it's actually going to emit.
+func (storj *StorjDS) queryOffsetLimit(q dsq.Query, list rawLister, value func(string) ([]byte, error)) dsq.Results {
+	rawQuery := dsq.Query{
+		Prefix:   q.Prefix,
+		KeysOnly: q.KeysOnly,
+	}
+
+	skipped := 0
+	returned := 0
+
+	return dsq.ResultsFromIterator(rawQuery, dsq.Iterator{
+		Close: func() error {
+			return nil
+		},
+		Next: func() (dsq.Result, bool) {
+			for {
+				if q.Limit != 0 && returned >= q.Limit {
+					return dsq.Result{}, false
+				}
+
+				raw, more, err := list()
+				if err != nil {
+					return dsq.Result{Error: err}, false
+				}
+				if !more {
+					return dsq.Result{}, false
+				}
+
+				if skipped < q.Offset {
+					skipped++
+					continue
+				}
+
+				entry := dsq.Entry{
+					Key:  "/" + raw.key,
+					Size: raw.size,
+				}
+				if !q.KeysOnly {
+					v, err := value(entry.Key)
+					if err != nil {
+						return dsq.Result{Error: err}, false
+					}
+					entry.Value = v
+				}
+
+				returned++
+				return dsq.Result{Entry: entry}, true
+			}
+		},
+	})
+}
+
+// queryBuffered fetches every entry matching q.Prefix up front, capped at
+// Config.MaxQueryBufferEntries, then applies q.Orders/q.Filters/q.Offset/
+// q.Limit with dsq.NaiveQueryApply. A bucket with more matching entries
+// than the cap fails the query outright rather than silently buffering an
+// unbounded amount of memory.
+func (storj *StorjDS) queryBuffered(q dsq.Query, list rawLister, value func(string) ([]byte, error)) (dsq.Results, error) {
+	max := storj.MaxQueryBufferEntries
+	if max <= 0 {
+		max = defaultMaxQueryBufferEntries
+	}
+
+	rawQuery := dsq.Query{
+		Prefix:   q.Prefix,
+		KeysOnly: q.KeysOnly,
+	}
+
+	buffered := 0
+
+	results := dsq.ResultsFromIterator(rawQuery, dsq.Iterator{
+		Close: func() error {
+			return nil
+		},
+		Next: func() (dsq.Result, bool) {
+			raw, more, err := list()
+			if err != nil {
+				return dsq.Result{Error: err}, false
+			}
+			if !more {
+				return dsq.Result{}, false
+			}
+
+			buffered++
+			if buffered > max {
+				return dsq.Result{Error: fmt.Errorf("storjds: query with Orders/Filters would buffer more than %d entries, set Config.MaxQueryBufferEntries to raise the limit", max)}, false
+			}
+
+			entry := dsq.Entry{
+				Key:  "/" + raw.key,
+				Size: raw.size,
+			}
+			if !q.KeysOnly {
+				v, err := value(entry.Key)
+				if err != nil {
+					return dsq.Result{Error: err}, false
+				}
+				entry.Value = v
+			}
+			return dsq.Result{Entry: entry}, true
+		},
+	})
+
+	return dsq.NaiveQueryApply(q, results), nil
+}
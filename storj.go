@@ -4,49 +4,103 @@
 package storjds
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
-	dsq "github.com/ipfs/go-datastore/query"
 	"github.com/zeebo/errs"
 
 	"storj.io/uplink"
 )
 
+// defaultReadBufferSize is used for streaming copies when
+// Config.ReadBufferSize is left at its zero value.
+const defaultReadBufferSize = 32 * 1024
+
 type StorjDS struct {
 	Config
 	Project *uplink.Project
 	logFile *os.File
-	logger  *log.Logger
+	logger  Logger
+	metrics *metrics
+	bufPool *sync.Pool
+	pack    *PackStore
 }
 
 type Config struct {
 	AccessGrant string
 	Bucket      string
 	LogFile     string
+
+	// Logger receives a structured event for every operation. Takes
+	// precedence over LogFile; when neither is set, events are discarded.
+	Logger Logger
+
+	// MetricsRegisterer, when set, registers Prometheus counters and
+	// histograms (ops by kind, bytes in/out, latency, not-found rate) so
+	// operators can alert without parsing log files.
+	MetricsRegisterer MetricsRegisterer
+
+	// ReadBufferSize sets the size of the pooled buffers used to stream
+	// values to and from Storj. Defaults to defaultReadBufferSize.
+	ReadBufferSize int
+
+	// BatchConcurrency sets how many Put/Delete ops a Batch.Commit runs at
+	// once. Defaults to defaultBatchConcurrency.
+	BatchConcurrency int
+
+	// Pack, when set, enables pack-file aggregation: Put/Get/Has/GetSize/
+	// Delete are routed through a PackStore instead of each key being its
+	// own Storj object, and Query lists the pack index instead of the
+	// bucket (which otherwise only contains pack objects, not one object
+	// per key). Sync and Batch are unaffected, since PackStore only
+	// implements the keyed single-object operations plus Query. A pack
+	// filling up and getting uploaded doesn't block concurrent
+	// Put/Get/Has/Delete calls on other keys (the upload runs outside
+	// PackStore's lock), so a Batch.Commit still fans out across
+	// BatchConcurrency workers; Flush and Close, which seal synchronously
+	// on request, still block for the duration of their own upload.
+	Pack *PackConfig
+
+	// MaxQueryBufferEntries bounds how many entries Query will hold in
+	// memory at once. Only queries with Orders or Filters are affected,
+	// since those require every matching entry (and, if q.KeysOnly is
+	// false, its value) to be pulled in before they can be applied;
+	// plain Offset/Limit queries stream instead. Defaults to
+	// defaultMaxQueryBufferEntries.
+	MaxQueryBufferEntries int
 }
 
 func NewStorjDatastore(conf Config) (*StorjDS, error) {
-	logger := log.New(io.Discard, "", 0) // default no-op logger
+	logger := conf.Logger
 	var logFile *os.File
 
-	if len(conf.LogFile) > 0 {
+	if conf.ReadBufferSize <= 0 {
+		conf.ReadBufferSize = defaultReadBufferSize
+	}
+
+	if logger == nil && len(conf.LogFile) > 0 {
 		var err error
 		logFile, err = os.OpenFile(conf.LogFile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create log file: %s", err)
 		}
-		logger = log.New(logFile, "", log.LstdFlags)
+		logger = stdLogger{log: log.New(logFile, "", log.LstdFlags)}
 	}
 
-	logger.Println("NewStorjDatastore")
+	if logger == nil {
+		logger = noopLogger{}
+	}
+
+	logger.Log(LogEvent{Op: "NewStorjDatastore"})
 
 	access, err := uplink.ParseAccess(conf.AccessGrant)
 	if err != nil {
@@ -58,53 +112,92 @@ func NewStorjDatastore(conf Config) (*StorjDS, error) {
 		return nil, fmt.Errorf("failed to open project: %s", err)
 	}
 
-	return &StorjDS{
+	storj := &StorjDS{
 		Config:  conf,
 		Project: project,
 		logFile: logFile,
 		logger:  logger,
-	}, nil
+		metrics: newMetrics(conf.MetricsRegisterer),
+		bufPool: &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, conf.ReadBufferSize)
+				return &buf
+			},
+		},
+	}
+
+	if conf.Pack != nil {
+		pack, err := NewPackStore(storj, *conf.Pack)
+		if err != nil {
+			return nil, err
+		}
+		storj.pack = pack
+	}
+
+	return storj, nil
 }
 
-func (storj *StorjDS) Put(key ds.Key, value []byte) error {
-	storj.logger.Printf("Put --- key: %s --- bytes: %d\n", key.String(), len(value))
+// logOp records a structured LogEvent and the matching Prometheus
+// observation for a single operation.
+func (storj *StorjDS) logOp(op, key string, bytes int, start time.Time, err error) {
+	duration := time.Since(start)
+	storj.logger.Log(LogEvent{Op: op, Key: key, Bytes: bytes, Duration: duration, Err: err})
+	storj.metrics.observe(op, bytes, duration, err)
+}
 
-	upload, err := storj.Project.UploadObject(context.Background(), storj.Bucket, storjKey(key), nil)
-	if err != nil {
-		return err
-	}
+func (storj *StorjDS) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
+	start := time.Now()
+	defer func() { storj.logOp("put", key.String(), len(value), start, err) }()
 
-	_, err = upload.Write(value)
-	if err != nil {
-		return err
+	if storj.pack != nil {
+		return storj.pack.Put(ctx, key, value)
 	}
 
-	return upload.Commit()
+	return storj.PutStream(ctx, key, bytes.NewReader(value))
 }
 
-func (storj *StorjDS) Sync(prefix ds.Key) error {
-	storj.logger.Printf("Sync --- prefix: %s\n", prefix.String())
+func (storj *StorjDS) Sync(ctx context.Context, prefix ds.Key) (err error) {
+	start := time.Now()
+	defer func() { storj.logOp("sync", prefix.String(), 0, start, err) }()
+
 	return nil
 }
 
-func (storj *StorjDS) Get(key ds.Key) ([]byte, error) {
-	storj.logger.Printf("Get --- key: %s\n", key.String())
+func (storj *StorjDS) Get(ctx context.Context, key ds.Key) (result []byte, err error) {
+	start := time.Now()
+	defer func() { storj.logOp("get", key.String(), len(result), start, err) }()
+
+	if storj.pack != nil {
+		result, err = storj.pack.Get(ctx, key)
+		return result, err
+	}
 
-	download, err := storj.Project.DownloadObject(context.Background(), storj.Bucket, storjKey(key), nil)
+	download, err := storj.GetStream(ctx, key)
 	if err != nil {
-		if isNotFound(err) {
-			return nil, ds.ErrNotFound
-		}
+		return nil, err
+	}
+	defer download.Close()
+
+	buf := storj.bufPool.Get().(*[]byte)
+	defer storj.bufPool.Put(buf)
+
+	var out bytes.Buffer
+	if _, err := io.CopyBuffer(&out, download, *buf); err != nil {
 		return nil, err
 	}
 
-	return ioutil.ReadAll(download)
+	return out.Bytes(), nil
 }
 
-func (storj *StorjDS) Has(key ds.Key) (exists bool, err error) {
-	storj.logger.Printf("Has --- key: %s\n", key.String())
+func (storj *StorjDS) Has(ctx context.Context, key ds.Key) (exists bool, err error) {
+	start := time.Now()
+	defer func() { storj.logOp("has", key.String(), 0, start, err) }()
 
-	_, err = storj.Project.StatObject(context.Background(), storj.Bucket, storjKey(key))
+	if storj.pack != nil {
+		return storj.pack.Has(ctx, key)
+	}
+
+	_, err = storj.Project.StatObject(ctx, storj.Bucket, storjKey(key))
 	if err != nil {
 		if isNotFound(err) {
 			return false, nil
@@ -115,11 +208,17 @@ func (storj *StorjDS) Has(key ds.Key) (exists bool, err error) {
 	return true, nil
 }
 
-func (storj *StorjDS) GetSize(key ds.Key) (size int, err error) {
-	// Commented because this method is invoked very often and it is noisy.
-	// storj.logger.Printf("GetSize --- key: %s\n", key.String())
+func (storj *StorjDS) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
+	// Not logged via the usual defer: this is invoked very often and would
+	// be noisy, but it's still observed in metrics below.
+	start := time.Now()
+	defer func() { storj.metrics.observe("get_size", 0, time.Since(start), err) }()
 
-	obj, err := storj.Project.StatObject(context.Background(), storj.Bucket, storjKey(key))
+	if storj.pack != nil {
+		return storj.pack.GetSize(ctx, key)
+	}
+
+	obj, err := storj.Project.StatObject(ctx, storj.Bucket, storjKey(key))
 	if err != nil {
 		if isNotFound(err) {
 			return -1, ds.ErrNotFound
@@ -130,10 +229,15 @@ func (storj *StorjDS) GetSize(key ds.Key) (size int, err error) {
 	return int(obj.System.ContentLength), nil
 }
 
-func (storj *StorjDS) Delete(key ds.Key) error {
-	storj.logger.Printf("Delete --- key: %s\n", key.String())
+func (storj *StorjDS) Delete(ctx context.Context, key ds.Key) (err error) {
+	start := time.Now()
+	defer func() { storj.logOp("delete", key.String(), 0, start, err) }()
 
-	_, err := storj.Project.DeleteObject(context.Background(), storj.Bucket, storjKey(key))
+	if storj.pack != nil {
+		return storj.pack.Delete(ctx, key)
+	}
+
+	_, err = storj.Project.DeleteObject(ctx, storj.Bucket, storjKey(key))
 	if isNotFound(err) {
 		// delete is idempotent
 		err = nil
@@ -142,57 +246,8 @@ func (storj *StorjDS) Delete(key ds.Key) error {
 	return err
 }
 
-func (storj *StorjDS) Query(q dsq.Query) (dsq.Results, error) {
-	storj.logger.Printf("Query --- %s\n", q.String())
-
-	if q.Orders != nil || q.Filters != nil {
-		return nil, fmt.Errorf("storjds: filters or orders are not supported")
-	}
-
-	// Storj stores a "/foo" key as "foo" so we need to trim the leading "/"
-	q.Prefix = strings.TrimPrefix(q.Prefix, "/")
-
-	list := storj.Project.ListObjects(context.Background(), storj.Bucket, &uplink.ListObjectsOptions{
-		Prefix:    q.Prefix,
-		Recursive: true,
-		System:    true, // TODO: enable only if q.ReturnsSizes = true
-		// Cursor: TODO,
-	})
-	if list.Err() != nil {
-		return nil, list.Err()
-	}
-
-	return dsq.ResultsFromIterator(q, dsq.Iterator{
-		Close: func() error {
-			return nil
-		},
-		Next: func() (dsq.Result, bool) {
-			// TODO: skip offset, apply limit
-			more := list.Next()
-			if !more {
-				if list.Err() != nil {
-					return dsq.Result{Error: list.Err()}, false
-				}
-				return dsq.Result{}, false
-			}
-			entry := dsq.Entry{
-				Key:  "/" + list.Item().Key,
-				Size: int(list.Item().System.ContentLength),
-			}
-			if !q.KeysOnly {
-				value, err := storj.Get(ds.NewKey(entry.Key))
-				if err != nil {
-					return dsq.Result{Error: err}, false
-				}
-				entry.Value = value
-			}
-			return dsq.Result{Entry: entry}, true
-		},
-	}), nil
-}
-
-func (storj *StorjDS) Batch() (ds.Batch, error) {
-	storj.logger.Println("Batch")
+func (storj *StorjDS) Batch(ctx context.Context) (ds.Batch, error) {
+	storj.logger.Log(LogEvent{Op: "batch"})
 
 	return &storjBatch{
 		storj: storj,
@@ -201,10 +256,18 @@ func (storj *StorjDS) Batch() (ds.Batch, error) {
 }
 
 func (storj *StorjDS) Close() error {
-	storj.logger.Println("Close")
+	storj.logger.Log(LogEvent{Op: "close"})
+
+	// Seal and upload the in-progress pack while the project is still open.
+	var packErr error
+	if storj.pack != nil {
+		packErr = storj.pack.Close()
+	}
 
 	err := storj.Project.Close()
 
+	err = errs.Combine(err, packErr)
+
 	if storj.logFile != nil {
 		err = errs.Combine(err, storj.logFile.Close())
 	}
@@ -220,54 +283,4 @@ func isNotFound(err error) bool {
 	return errors.Is(err, uplink.ErrObjectNotFound)
 }
 
-type storjBatch struct {
-	storj *StorjDS
-	ops   map[ds.Key]batchOp
-}
-
-type batchOp struct {
-	value  []byte
-	delete bool
-}
-
-func (b *storjBatch) Put(key ds.Key, value []byte) error {
-	b.storj.logger.Printf("BatchPut --- key: %s --- bytes: %d\n", key.String(), len(value))
-
-	b.ops[key] = batchOp{
-		value:  value,
-		delete: false,
-	}
-
-	return nil
-}
-
-func (b *storjBatch) Delete(key ds.Key) error {
-	b.storj.logger.Printf("BatchDelete --- key: %s\n", key.String())
-
-	b.ops[key] = batchOp{
-		value:  nil,
-		delete: true,
-	}
-
-	return nil
-}
-
-func (b *storjBatch) Commit() error {
-	b.storj.logger.Println("BatchCommit")
-
-	for key, op := range b.ops {
-		var err error
-		if op.delete {
-			err = b.storj.Delete(key)
-		} else {
-			err = b.storj.Put(key, op.value)
-		}
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 var _ ds.Batching = (*StorjDS)(nil)
@@ -0,0 +1,87 @@
+// Copyright (C) 2021 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storjds
+
+import (
+	"context"
+	"io"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/zeebo/errs"
+
+	"storj.io/uplink"
+)
+
+// GetStream returns a reader for the value stored under key without
+// buffering it into memory, so the caller can stream arbitrarily large
+// blocks straight to their destination. The caller must Close the
+// returned ReadCloser. It reads the object named by key directly and does
+// not consult the pack index, so with Config.Pack set it does not find
+// values written through Put.
+func (storj *StorjDS) GetStream(ctx context.Context, key ds.Key) (_ io.ReadCloser, err error) {
+	start := time.Now()
+	defer func() { storj.logOp("get_stream", key.String(), 0, start, err) }()
+
+	download, err := storj.Project.DownloadObject(ctx, storj.Bucket, storjKey(key), nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ds.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return download, nil
+}
+
+// downloadRange fetches just [offset, offset+length) of a raw (already
+// storjKey-encoded) object key, for callers like PackStore that address
+// sub-ranges of a larger pack object directly.
+func (storj *StorjDS) downloadRange(ctx context.Context, key string, offset, length int64) (_ io.ReadCloser, err error) {
+	start := time.Now()
+	defer func() { storj.logOp("download_range", key, 0, start, err) }()
+
+	download, err := storj.Project.DownloadObject(ctx, storj.Bucket, key, &uplink.DownloadOptions{
+		Offset: offset,
+		Length: length,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ds.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return download, nil
+}
+
+// logPack lets PackStore emit structured events through the same Logger
+// as the rest of StorjDS without depending on *StorjDS directly.
+func (storj *StorjDS) logPack(event LogEvent) {
+	storj.logger.Log(event)
+}
+
+// PutStream uploads the value read from r under key, copying through a
+// pooled buffer so large blocks never need to be held in memory all at
+// once.
+func (storj *StorjDS) PutStream(ctx context.Context, key ds.Key, r io.Reader) (err error) {
+	start := time.Now()
+	var written int64
+	defer func() { storj.logOp("put_stream", key.String(), int(written), start, err) }()
+
+	upload, err := storj.Project.UploadObject(ctx, storj.Bucket, storjKey(key), nil)
+	if err != nil {
+		return err
+	}
+
+	buf := storj.bufPool.Get().(*[]byte)
+	defer storj.bufPool.Put(buf)
+
+	written, err = io.CopyBuffer(upload, r, *buf)
+	if err != nil {
+		return errs.Combine(err, upload.Abort())
+	}
+
+	return upload.Commit()
+}